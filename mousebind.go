@@ -26,11 +26,15 @@ type MouseBindKey struct {
 
 // AttackMouseBindCallback associates an (event, window, mods, button)
 // with a callback.
+//
+// This no longer issues the underlying GrabButton itself (and no longer
+// assumes the caller already did). Adding a key here just changes the
+// desired grab set; see grabReconciler in mousebind_grab.go for the
+// goroutine that makes the server's actual grabs match it.
 func (xu *XUtil) AttachMouseBindCallback(evtype int, win xproto.Window,
 	mods uint16, button xproto.Button, fun MouseBindCallback) {
 
 	xu.mousebindsLck.Lock()
-	defer xu.mousebindsLck.Unlock()
 
 	// Create key
 	key := MouseBindKey{evtype, win, mods, button}
@@ -41,7 +45,9 @@ func (xu *XUtil) AttachMouseBindCallback(evtype int, win xproto.Window,
 	}
 
 	xu.mousebinds[key] = append(xu.mousebinds[key], fun)
-	xu.mousegrabs[key] += 1
+	xu.mousebindsLck.Unlock()
+
+	xu.scheduleGrabReconcile()
 }
 
 // MouseBindKeys returns a copy of all the keys in the 'mousebinds' map.
@@ -100,26 +106,29 @@ func (xu *XUtil) ConnectedMouseBind(evtype int, win xproto.Window) bool {
 }
 
 // DetachMouseBindWindow removes all callbacks associated with a particular
-// window and event type (either ButtonPress or ButtonRelease)
-// Also decrements the counter in the corresponding 'mousegrabs' map
-// appropriately.
+// window and event type (either ButtonPress or ButtonRelease), which
+// removes the corresponding tuple from the desired grab set. As with
+// AttachMouseBindCallback, the actual UngrabButton is issued later by the
+// grab reconciler, not here.
 func (xu *XUtil) DetachMouseBindWindow(evtype int, win xproto.Window) {
 	xu.mousebindsLck.Lock()
-	defer xu.mousebindsLck.Unlock()
 
 	// Since we can't create a full key, loop through all mouse binds
 	// and check if evtype and window match.
 	for key, _ := range xu.mousebinds {
 		if key.Evtype == evtype && key.Win == win {
-			xu.mousegrabs[key] -= len(xu.mousebinds[key])
 			delete(xu.mousebinds, key)
 		}
 	}
+	xu.mousebindsLck.Unlock()
+
+	xu.scheduleGrabReconcile()
 }
 
-// MouseBindGrabs returns the number of grabs on a particular
-// event/window/mods/button combination. Namely, this combination
-// uniquely identifies a grab. If it's repeated, we get BadAccess.
+// MouseBindGrabs returns the number of callbacks registered for a
+// particular event/window/mods/button combination. Namely, this
+// combination uniquely identifies a grab: if more than one is ever
+// actually issued to the server for the same tuple, we get BadAccess.
 func (xu *XUtil) MouseBindGrabs(evtype int, win xproto.Window, mods uint16,
 	button xproto.Button) int {
 
@@ -127,7 +136,7 @@ func (xu *XUtil) MouseBindGrabs(evtype int, win xproto.Window, mods uint16,
 	defer xu.mousebindsLck.RUnlock()
 
 	key := MouseBindKey{evtype, win, mods, button}
-	return xu.mousegrabs[key] // returns 0 if key does not exist
+	return len(xu.mousebinds[key]) // returns 0 if key does not exist
 }
 
 // MouseDragFun is the kind of function used on each dragging step
@@ -172,3 +181,174 @@ func (xu *XUtil) MouseDragEnd() MouseDragFun {
 func (xu *XUtil) MouseDragEndSet(f MouseDragFun) {
 	xu.mouseDragEnd = f
 }
+
+// MouseDragCancelFun is run instead of a drag's end callback when its
+// button is released before the configured threshold was ever crossed --
+// i.e., when the gesture turns out to have been a click rather than a
+// drag.
+type MouseDragCancelFun func(xu *XUtil, rootX, rootY, eventX, eventY int)
+
+// buttonDrag is the state tracked for a single button's in-progress drag.
+// Keeping this in a map keyed by button, rather than the single
+// mouseDrag/mouseDragStep/mouseDragEnd triple above, lets multiple
+// buttons drag at once -- e.g. a middle-button scroll while a left-button
+// resize is also in progress.
+type buttonDrag struct {
+	began      bool // true once the pointer has crossed the threshold
+	startRootX int
+	startRootY int
+	// lastRootX/Y and lastEventX/Y track the most recent position
+	// reported to MouseDragStepButton (or, if the pointer hasn't moved yet,
+	// the starting root position for both pairs, since MouseDragBegin is
+	// given no event coordinates), so MouseDragAbort can finish the drag at
+	// wherever the pointer actually is instead of where it started.
+	lastRootX  int
+	lastRootY  int
+	lastEventX int
+	lastEventY int
+	step       MouseDragFun
+	end        MouseDragFun
+	cancel     MouseDragCancelFun
+}
+
+// MouseDragThresholdSet sets the minimum distance, in pixels, the pointer
+// must travel from where a drag began before MouseDragStepButton will
+// start running the step callback. Motion events under the threshold are
+// swallowed; if the button is released before the threshold is crossed,
+// the drag's MouseDragCancelFun runs instead of its end callback. A
+// threshold of 0 (the default) preserves the old behavior of starting a
+// drag on the very first motion event.
+func (xu *XUtil) MouseDragThresholdSet(px int) {
+	xu.mousebindsLck.Lock()
+	defer xu.mousebindsLck.Unlock()
+
+	xu.mouseDragThreshold = px
+}
+
+// MouseDragThreshold returns the currently configured drag threshold.
+func (xu *XUtil) MouseDragThreshold() int {
+	xu.mousebindsLck.RLock()
+	defer xu.mousebindsLck.RUnlock()
+
+	return xu.mouseDragThreshold
+}
+
+// MouseDragBegin records the start of a drag for 'button' at the given
+// root coordinates, along with the step/end/cancel callbacks to use for
+// the rest of the gesture.
+func (xu *XUtil) MouseDragBegin(button xproto.Button, rootX, rootY int,
+	step, end MouseDragFun, cancel MouseDragCancelFun) {
+
+	xu.mousebindsLck.Lock()
+	defer xu.mousebindsLck.Unlock()
+
+	if xu.mouseDrags == nil {
+		xu.mouseDrags = make(map[xproto.Button]*buttonDrag)
+	}
+
+	xu.mouseDrags[button] = &buttonDrag{
+		startRootX: rootX,
+		startRootY: rootY,
+		lastRootX:  rootX,
+		lastRootY:  rootY,
+		lastEventX: rootX,
+		lastEventY: rootY,
+		step:       step,
+		end:        end,
+		cancel:     cancel,
+	}
+	xu.mouseDrag = true
+}
+
+// MouseDragStepButton should be called on every pointer motion event
+// while 'button' is held down as part of a drag started with
+// MouseDragBegin. It enforces the configured drag threshold: the step
+// callback only runs once the pointer has moved far enough from where
+// the drag began.
+func (xu *XUtil) MouseDragStepButton(button xproto.Button,
+	rootX, rootY, eventX, eventY int) {
+
+	xu.mousebindsLck.Lock()
+	drag, ok := xu.mouseDrags[button]
+	if !ok {
+		xu.mousebindsLck.Unlock()
+		return
+	}
+
+	drag.lastRootX, drag.lastRootY = rootX, rootY
+	drag.lastEventX, drag.lastEventY = eventX, eventY
+
+	if !drag.began {
+		dx, dy := rootX-drag.startRootX, rootY-drag.startRootY
+		threshold := xu.mouseDragThreshold
+		if dx*dx+dy*dy < threshold*threshold {
+			xu.mousebindsLck.Unlock()
+			return
+		}
+		drag.began = true
+	}
+	step := drag.step
+	xu.mousebindsLck.Unlock()
+
+	if step != nil {
+		step(xu, rootX, rootY, eventX, eventY)
+	}
+}
+
+// MouseDragEndButton finishes the drag associated with 'button'. If the
+// threshold configured via MouseDragThresholdSet was never crossed, the
+// drag's MouseDragCancelFun runs instead of its end callback, since the
+// gesture was a click rather than a drag.
+func (xu *XUtil) MouseDragEndButton(button xproto.Button,
+	rootX, rootY, eventX, eventY int) {
+
+	xu.mousebindsLck.Lock()
+	drag, ok := xu.mouseDrags[button]
+	if ok {
+		delete(xu.mouseDrags, button)
+	}
+	if len(xu.mouseDrags) == 0 {
+		xu.mouseDrag = false
+	}
+	xu.mousebindsLck.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if drag.began {
+		if drag.end != nil {
+			drag.end(xu, rootX, rootY, eventX, eventY)
+		}
+	} else if drag.cancel != nil {
+		drag.cancel(xu, rootX, rootY, eventX, eventY)
+	}
+}
+
+// MouseDragAbort forcibly ends every in-progress drag -- as if each
+// button's end (or cancel, if its threshold was never crossed) callback
+// fired at its last known position -- and ungrabs the pointer. It's meant
+// for situations where a grab is broken out from under us, such as a
+// keyboard shortcut stealing focus or a focus change event arriving on
+// the event loop mid-drag, so mousebind's bookkeeping can be brought back
+// in sync with reality.
+func (xu *XUtil) MouseDragAbort() {
+	xu.mousebindsLck.Lock()
+	drags := xu.mouseDrags
+	xu.mouseDrags = make(map[xproto.Button]*buttonDrag)
+	xu.mouseDrag = false
+	xu.mousebindsLck.Unlock()
+
+	for _, drag := range drags {
+		switch {
+		case drag.began && drag.end != nil:
+			drag.end(xu, drag.lastRootX, drag.lastRootY,
+				drag.lastEventX, drag.lastEventY)
+		case !drag.began && drag.cancel != nil:
+			drag.cancel(xu, drag.lastRootX, drag.lastRootY,
+				drag.lastEventX, drag.lastEventY)
+		}
+	}
+
+	xproto.UngrabPointer(xu.Conn(), 0)
+}
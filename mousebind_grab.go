@@ -0,0 +1,436 @@
+/*
+   mousebind_grab.go reconciles the grabs implied by XUtil's mousebinds
+   map with what has actually been requested of the X server.
+
+   Previously, AttachMouseBindCallback/DetachMouseBindWindow just adjusted
+   a refcount in 'mousegrabs' and trusted the caller to have already
+   issued the matching GrabButton/UngrabButton. That's easy to get out of
+   sync: a caller could forget the ungrab, or issue it with the wrong
+   modifier set. Here, XUtil is the single source of truth for the
+   desired (win, mods, button) grab set, and a background goroutine does
+   the actual grabbing/ungrabbing in one batch per change.
+*/
+package xgbutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// grabReconciler owns the background goroutine that keeps the server's
+// actual button grabs in sync with the desired set derived from
+// mousebinds.
+type grabReconciler struct {
+	work chan struct{}
+
+	lck  sync.Mutex
+	cond *sync.Cond
+	// granted records, per key, exactly which ignored-modifier variants
+	// currently have a real GrabButton outstanding on the server. This is
+	// tracked per-variant (rather than one bool per key) so that variants
+	// granted under an older ignored-modifier set stay known after a
+	// refresh: future passes only request the variants still missing, and
+	// after DetachMouseBindWindow the reconciler ungrabs exactly what's
+	// actually there instead of leaking. A grab call that fails partway
+	// rolls back what it grabbed, so nothing held goes unrecorded here.
+	granted    map[MouseBindKey]map[uint16]bool
+	ignoreMods []uint16
+	synced     bool
+}
+
+// grabs lazily starts the reconciler goroutine the first time it's
+// needed, so XUtil values that never touch mousebind don't pay for it.
+func (xu *XUtil) grabs() *grabReconciler {
+	xu.grabReconcilerInit.Do(func() {
+		r := &grabReconciler{
+			work:    make(chan struct{}, 1),
+			granted: make(map[MouseBindKey]map[uint16]bool),
+		}
+		// Seed with a real lookup rather than a guess: CapsLock is
+		// static, but which bit NumLock/ScrollLock land on depends on
+		// the keyboard mapping, so we ask the server before issuing a
+		// single grab. (refreshIgnoreMods always includes CapsLock even
+		// if NumLock/ScrollLock aren't bound to anything.)
+		r.ignoreMods = xu.refreshIgnoreMods()
+		r.cond = sync.NewCond(&r.lck)
+		// Queue an initial pass so MouseBindSync returns even if no
+		// binding is ever attached or detached.
+		r.work <- struct{}{}
+		xu.grabReconciler = r
+		go r.loop(xu)
+	})
+	return xu.grabReconciler
+}
+
+// scheduleGrabReconcile marks the grab state dirty. It's safe to call
+// from anywhere; multiple calls before the reconciler wakes up coalesce
+// into a single pass.
+func (xu *XUtil) scheduleGrabReconcile() {
+	r := xu.grabs()
+
+	// Queue the pass under the same lock loop holds when it marks a pass
+	// done, so a pass that began before this change can't report it synced.
+	r.lck.Lock()
+	r.synced = false
+	select {
+	case r.work <- struct{}{}:
+	default: // a reconcile is already pending; it'll see this change too
+	}
+	r.lck.Unlock()
+}
+
+// MouseBindSync blocks until the server's grabs match the desired set
+// implied by the current mousebinds, or until ctx is done. Window
+// managers can use this at startup to know grabs are in place before
+// mapping windows, and tests can use it to avoid racing the reconciler.
+func (xu *XUtil) MouseBindSync(ctx context.Context) error {
+	r := xu.grabs()
+
+	done := make(chan struct{})
+	go func() {
+		r.lck.Lock()
+		for !r.synced {
+			r.cond.Wait()
+		}
+		r.lck.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// loop runs one reconcile pass each time scheduleGrabReconcile wakes it
+// up.
+func (r *grabReconciler) loop(xu *XUtil) {
+	for range r.work {
+		complete := r.reconcile(xu)
+
+		r.lck.Lock()
+		// A change scheduled during this pass has queued another one;
+		// stay unsynced until that pass has run.
+		if len(r.work) == 0 {
+			r.synced = complete
+			r.cond.Broadcast()
+		}
+		r.lck.Unlock()
+	}
+}
+
+// reconcile diffs the desired grab set against what's actually been
+// issued and grabs/ungrabs the difference in one batch. It reports
+// whether every grab it requested succeeded.
+func (r *grabReconciler) reconcile(xu *XUtil) bool {
+	desired := xu.desiredGrabKeys()
+
+	r.lck.Lock()
+	ignoreMods := r.ignoreMods
+	r.lck.Unlock()
+
+	for key := range r.grantedKeys() {
+		if !desired[key] {
+			r.ungrab(xu, key)
+		}
+	}
+
+	complete := true
+	refreshedMods := false
+	for key := range desired {
+		if r.isFullyGranted(key, ignoreMods) {
+			continue
+		}
+
+		err := r.grab(xu, key, ignoreMods)
+		if isBadAccess(err) && !refreshedMods {
+			// Our ignored-modifier set is probably stale -- e.g.
+			// NumLock was remapped to a different modifier bit since we
+			// last read the modifier mapping. Refresh it once and retry
+			// every grab that failed this pass with the new set.
+			ignoreMods = xu.refreshIgnoreMods()
+			r.setIgnoreMods(ignoreMods)
+			refreshedMods = true
+			err = r.grab(xu, key, ignoreMods)
+		}
+		if err != nil {
+			complete = false
+		}
+		// A failed grab call rolls back whatever it grabbed and records
+		// nothing, so r.granted still matches the server. A variant held
+		// by another client indefinitely will simply keep failing (and
+		// the key keep getting retried) on future passes; nothing is
+		// left grabbed without a record in r.granted either way.
+	}
+	return complete
+}
+
+// desiredGrabKeys returns the set of logical (evtype, win, mods, button)
+// tuples that should have a grab outstanding, derived straight from the
+// mousebinds map -- there's deliberately no separate bookkeeping to drift
+// out of sync with it.
+func (xu *XUtil) desiredGrabKeys() map[MouseBindKey]bool {
+	xu.mousebindsLck.RLock()
+	defer xu.mousebindsLck.RUnlock()
+
+	desired := make(map[MouseBindKey]bool, len(xu.mousebinds))
+	for key := range xu.mousebinds {
+		desired[key] = true
+	}
+	return desired
+}
+
+// grantedKeys returns the set of keys that currently have at least one
+// ignored-modifier variant grabbed.
+func (r *grabReconciler) grantedKeys() map[MouseBindKey]bool {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	keys := make(map[MouseBindKey]bool, len(r.granted))
+	for k := range r.granted {
+		keys[k] = true
+	}
+	return keys
+}
+
+// grantedVariants returns a copy of the ignored-modifier variants
+// currently grabbed for 'key'.
+func (r *grabReconciler) grantedVariants(key MouseBindKey) map[uint16]bool {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	have := make(map[uint16]bool, len(r.granted[key]))
+	for m := range r.granted[key] {
+		have[m] = true
+	}
+	return have
+}
+
+// isFullyGranted reports whether every variant in 'ignoreMods' is
+// currently grabbed for 'key'.
+func (r *grabReconciler) isFullyGranted(key MouseBindKey, ignoreMods []uint16) bool {
+	have := r.grantedVariants(key)
+	for _, m := range ignoreMods {
+		if !have[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// markGranted records that 'mods' are now grabbed for 'key'.
+func (r *grabReconciler) markGranted(key MouseBindKey, mods []uint16) {
+	if len(mods) == 0 {
+		return
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	if r.granted[key] == nil {
+		r.granted[key] = make(map[uint16]bool, len(mods))
+	}
+	for _, m := range mods {
+		r.granted[key][m] = true
+	}
+}
+
+// clearGranted forgets every variant grabbed for 'key'.
+func (r *grabReconciler) clearGranted(key MouseBindKey) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	delete(r.granted, key)
+}
+
+func (r *grabReconciler) setIgnoreMods(mods []uint16) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.ignoreMods = mods
+}
+
+// grab brings the server's grabs for 'key' up to date with every variant
+// in 'ignoreMods': it skips variants already held (per r.granted) and
+// issues GrabButton for the rest, stopping at the first one that fails.
+// The variants it grabbed are recorded in r.granted only once all of them
+// have succeeded.
+//
+// If a GrabButton fails partway through, every variant *this call*
+// itself just grabbed is rolled back with UngrabButton before returning
+// the error -- so a failed call never leaves the server in a state that
+// r.granted doesn't already know about. (Variants granted by an earlier,
+// successful call are untouched either way.) Without this, a single
+// BadAccess used to abort the whole call with no record of the variants
+// that did succeed, so the next reconcile pass re-requested -- and
+// re-failed on -- every variant, forever, and DetachMouseBindWindow had
+// nothing to ungrab, leaking the grabs that had gone through.
+func (r *grabReconciler) grab(xu *XUtil, key MouseBindKey, ignoreMods []uint16) error {
+	have := r.grantedVariants(key)
+
+	var justGranted []uint16
+	var grabErr error
+
+	for _, extra := range ignoreMods {
+		if have[extra] {
+			continue
+		}
+
+		err := xproto.GrabButtonChecked(xu.Conn(), false, key.Win,
+			xproto.EventMaskButtonPress|xproto.EventMaskButtonRelease|
+				xproto.EventMaskButtonMotion,
+			xproto.GrabModeAsync, xproto.GrabModeAsync,
+			0, 0, key.Button, key.Mod|extra).Check()
+		if err != nil {
+			grabErr = err
+			break
+		}
+		justGranted = append(justGranted, extra)
+	}
+
+	if grabErr != nil {
+		for _, extra := range justGranted {
+			xproto.UngrabButton(xu.Conn(), key.Button, key.Win, key.Mod|extra)
+		}
+		return grabErr
+	}
+
+	r.markGranted(key, justGranted)
+	return nil
+}
+
+// ungrab issues UngrabButton for every ignored-modifier variant actually
+// granted for 'key' -- not the reconciler's current ignoreMods, since
+// those may have been refreshed since some of these were granted -- and
+// forgets them.
+func (r *grabReconciler) ungrab(xu *XUtil, key MouseBindKey) {
+	for extra := range r.grantedVariants(key) {
+		xproto.UngrabButton(xu.Conn(), key.Button, key.Win, key.Mod|extra)
+	}
+	r.clearGranted(key)
+}
+
+// isBadAccess reports whether err is the X BadAccess error GrabButton
+// returns when a grab with this (window, mods, button) is already held
+// by someone else -- the signal that our ignored-modifier set has gone
+// stale.
+func isBadAccess(err error) bool {
+	_, ok := err.(xproto.AccessError)
+	return ok
+}
+
+// expandIgnoreMods builds every combination of the NumLock, CapsLock, and
+// ScrollLock masks (including none of them), so a grab fires whether or
+// not those lock keys happen to be engaged. A NumLock or ScrollLock mask
+// of 0 is left out, so the result has 8, 4, or 2 entries.
+func expandIgnoreMods(numLock, capsLock, scrollLock uint16) []uint16 {
+	base := []uint16{0, capsLock}
+	if numLock != 0 {
+		base = append(base, numLock, numLock|capsLock)
+	}
+	if scrollLock != 0 {
+		withScroll := make([]uint16, len(base))
+		for i, m := range base {
+			withScroll[i] = m | scrollLock
+		}
+		base = append(base, withScroll...)
+	}
+	return base
+}
+
+// Keysym values for the lock keys we care about, from keysymdef.h. XKB's
+// "NumLock" and "ScrollLock" virtual modifiers don't live at a fixed bit
+// -- they can be bound to any of Mod1..Mod5 depending on the keyboard
+// mapping -- so the only reliable way to find their real modifier mask is
+// to look at which keycode actually carries the Num_Lock/Scroll_Lock
+// keysym and see which modifier group that keycode is in.
+const (
+	keysymNumLock    = 0xff7f
+	keysymScrollLock = 0xff14
+)
+
+// refreshIgnoreMods re-reads the keyboard and modifier mappings to find
+// which modifier bits NumLock and ScrollLock are currently bound to (Lock
+// is always CapsLock) and rebuilds the ignored-modifier cross product
+// from that.
+func (xu *XUtil) refreshIgnoreMods() []uint16 {
+	numLock, scrollLock := xu.lockModMasks()
+	return expandIgnoreMods(numLock, xproto.ModMaskLock, scrollLock)
+}
+
+// lockModMasks walks the core GetModifierMapping table and, for every
+// keycode bound to Mod1 through Mod5, checks GetKeyboardMapping to see if
+// that keycode's keysym is Num_Lock or Scroll_Lock. It returns 0 for
+// either mask if that lock key isn't bound to any modifier at all, which
+// is a legitimate keyboard mapping (expandIgnoreMods treats 0 as "no
+// cross product needed for this one").
+func (xu *XUtil) lockModMasks() (numLock, scrollLock uint16) {
+	setup := xu.Conn().Setup()
+
+	mapping, err := xproto.GetModifierMapping(xu.Conn()).Reply()
+	if err != nil {
+		return 0, 0
+	}
+
+	keycodeCount := int(setup.MaxKeycode) - int(setup.MinKeycode) + 1
+	keysyms, err := xproto.GetKeyboardMapping(xu.Conn(),
+		setup.MinKeycode, byte(keycodeCount)).Reply()
+	if err != nil {
+		return 0, 0
+	}
+
+	perMod := int(mapping.KeycodesPerModifier)
+	// The eight modifier groups, in GetModifierMapping's fixed order, are
+	// Shift, Lock, Control, Mod1, Mod2, Mod3, Mod4, Mod5. NumLock/
+	// ScrollLock always land in one of the five Mod groups, never Shift/
+	// Lock/Control.
+	modMasks := [5]uint16{
+		xproto.ModMask1, xproto.ModMask2, xproto.ModMask3,
+		xproto.ModMask4, xproto.ModMask5,
+	}
+
+	for i, mask := range modMasks {
+		group := i + 3
+		for j := 0; j < perMod; j++ {
+			idx := group*perMod + j
+			if idx >= len(mapping.Keycodes) {
+				continue
+			}
+			kc := mapping.Keycodes[idx]
+			if kc == 0 {
+				continue
+			}
+
+			if keycodeHasKeysym(keysyms, setup.MinKeycode, kc, keysymNumLock) {
+				numLock = mask
+			}
+			if keycodeHasKeysym(keysyms, setup.MinKeycode, kc, keysymScrollLock) {
+				scrollLock = mask
+			}
+		}
+	}
+
+	return numLock, scrollLock
+}
+
+// keycodeHasKeysym reports whether any of the keysyms GetKeyboardMapping
+// reported for 'kc' equal 'sym'.
+func keycodeHasKeysym(reply *xproto.GetKeyboardMappingReply,
+	minKeycode, kc xproto.Keycode, sym uint32) bool {
+
+	perKeycode := int(reply.KeysymsPerKeycode)
+	start := int(kc-minKeycode) * perKeycode
+
+	for k := 0; k < perKeycode; k++ {
+		i := start + k
+		if i < 0 || i >= len(reply.Keysyms) {
+			continue
+		}
+		if uint32(reply.Keysyms[i]) == sym {
+			return true
+		}
+	}
+	return false
+}
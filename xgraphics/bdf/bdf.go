@@ -0,0 +1,222 @@
+/*
+Package bdf parses BDF bitmap fonts into a font.Face-compatible type, so
+xgbutil users aren't forced to ship TTF files just to render a status bar
+or menu label. The resulting Face plugs directly into
+xgraphics/render.GlyphSet, giving xgbutil a dependency-free text path with
+the wide Unicode coverage fonts like unifont and terminus already have.
+
+PCF fonts are not yet supported; see Parse's doc comment.
+*/
+package bdf
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// glyph holds one decoded character: its bitmap, its bearing relative to
+// the pen position, and how far to advance afterward.
+type glyph struct {
+	bitmap             *image.Alpha
+	bearingX, bearingY int
+	advance            int
+}
+
+// Face is a BDF font loaded into memory, satisfying font.Face so it can
+// be used anywhere an x/image/font.Face is expected -- including
+// xgraphics/render.NewGlyphSet.
+type Face struct {
+	ascent, descent int
+	glyphs          map[rune]*glyph
+}
+
+// Parse reads a BDF font from r. PCF fonts are binary and are not handled
+// here; a PCF loader would need its own reader and is left for a future
+// change, since BDF alone already covers the common bitmap fonts (such as
+// unifont and terminus) that ship source in that format.
+func Parse(r io.Reader) (*Face, error) {
+	f := &Face{glyphs: make(map[rune]*glyph)}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "FONT_ASCENT "):
+			f.ascent, _ = parseInt(line, "FONT_ASCENT")
+		case strings.HasPrefix(line, "FONT_DESCENT "):
+			f.descent, _ = parseInt(line, "FONT_DESCENT")
+		case strings.HasPrefix(line, "STARTCHAR"):
+			g, r, err := parseChar(scanner)
+			if err != nil {
+				return nil, err
+			}
+			// parseChar returns a nil glyph for unencoded characters
+			// (ENCODING -1 or a missing ENCODING line) -- routine in
+			// fonts like unifont and terminus. Skip storing it rather
+			// than planting a nil entry at rune 0 that later panics.
+			if g == nil {
+				continue
+			}
+			f.glyphs[r] = g
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if f.ascent == 0 && f.descent == 0 {
+		return nil, fmt.Errorf("bdf: missing FONT_ASCENT/FONT_DESCENT")
+	}
+
+	return f, nil
+}
+
+// parseChar consumes one STARTCHAR...ENDCHAR block (the STARTCHAR line
+// itself has already been read by the caller) and returns the decoded
+// glyph and the rune it encodes.
+func parseChar(scanner *bufio.Scanner) (*glyph, rune, error) {
+	var (
+		encoding           int
+		bbw, bbh, bbx, bby int
+		dwidth             int
+		bitmap             []uint32
+		inBitmap           bool
+	)
+	haveEncoding := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "ENDCHAR":
+			if !haveEncoding || encoding < 0 {
+				return nil, 0, nil
+			}
+
+			img := image.NewAlpha(image.Rect(0, 0, bbw, bbh))
+			for y := 0; y < bbh && y < len(bitmap); y++ {
+				row := bitmap[y]
+				for x := 0; x < bbw; x++ {
+					if row&(1<<uint(31-x)) != 0 {
+						img.SetAlpha(x, y, color.Alpha{A: 255})
+					}
+				}
+			}
+
+			g := &glyph{
+				bitmap:   img,
+				bearingX: bbx,
+				bearingY: bby,
+				advance:  dwidth,
+			}
+			return g, rune(encoding), nil
+
+		case strings.HasPrefix(line, "ENCODING "):
+			// "ENCODING -1 n" carries a non-standard code after the -1;
+			// only the first number decides whether the glyph is encoded.
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				encoding, _ = strconv.Atoi(fields[1])
+			}
+			haveEncoding = true
+
+		case strings.HasPrefix(line, "DWIDTH "):
+			// DWIDTH is "dwx0 dwy0"; only the horizontal advance is kept.
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				dwidth, _ = strconv.Atoi(fields[1])
+			}
+
+		case strings.HasPrefix(line, "BBX "):
+			fields := strings.Fields(line)
+			if len(fields) == 5 {
+				bbw, _ = strconv.Atoi(fields[1])
+				bbh, _ = strconv.Atoi(fields[2])
+				bbx, _ = strconv.Atoi(fields[3])
+				bby, _ = strconv.Atoi(fields[4])
+			}
+
+		case line == "BITMAP":
+			inBitmap = true
+			bitmap = make([]uint32, 0, bbh)
+
+		case inBitmap:
+			v, err := strconv.ParseUint(line, 16, 32)
+			if err != nil {
+				return nil, 0, fmt.Errorf("bdf: bad BITMAP row %q: %v", line, err)
+			}
+			// Hex rows are padded out to a byte boundary; shift so bit 31
+			// is always the leftmost pixel regardless of glyph width.
+			bitmap = append(bitmap, uint32(v)<<uint(32-4*len(line)))
+		}
+	}
+
+	return nil, 0, fmt.Errorf("bdf: unexpected EOF inside STARTCHAR block")
+}
+
+func parseInt(line, key string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, key)))
+}
+
+// Close implements font.Face. BDF faces hold no external resources.
+func (f *Face) Close() error { return nil }
+
+// Metrics implements font.Face.
+func (f *Face) Metrics() font.Metrics {
+	return font.Metrics{
+		Height:  fixed.I(f.ascent + f.descent),
+		Ascent:  fixed.I(f.ascent),
+		Descent: fixed.I(f.descent),
+	}
+}
+
+// Kern implements font.Face. BDF carries no kerning data, so this is
+// always zero.
+func (f *Face) Kern(r0, r1 rune) fixed.Int26_6 { return 0 }
+
+// GlyphAdvance implements font.Face.
+func (f *Face) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	g, ok := f.glyphs[r]
+	if !ok {
+		return 0, false
+	}
+	return fixed.I(g.advance), true
+}
+
+// GlyphBounds implements font.Face.
+func (f *Face) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	g, ok := f.glyphs[r]
+	if !ok {
+		return fixed.Rectangle26_6{}, 0, false
+	}
+
+	b := g.bitmap.Bounds()
+	return fixed.Rectangle26_6{
+		Min: fixed.P(g.bearingX, -g.bearingY-b.Dy()),
+		Max: fixed.P(g.bearingX+b.Dx(), -g.bearingY),
+	}, fixed.I(g.advance), true
+}
+
+// Glyph implements font.Face, and is the method xgraphics/render.GlyphSet
+// calls to rasterize a rune the first time it's drawn.
+func (f *Face) Glyph(dot fixed.Point26_6, r rune) (
+	dr image.Rectangle, mask image.Image, maskp image.Point,
+	advance fixed.Int26_6, ok bool) {
+
+	g, exists := f.glyphs[r]
+	if !exists {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+
+	x0 := dot.X.Round() + g.bearingX
+	y0 := dot.Y.Round() - g.bearingY - g.bitmap.Bounds().Dy()
+
+	dr = image.Rect(x0, y0, x0+g.bitmap.Bounds().Dx(), y0+g.bitmap.Bounds().Dy())
+	return dr, g.bitmap, image.Point{}, fixed.I(g.advance), true
+}
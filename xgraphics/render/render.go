@@ -0,0 +1,425 @@
+/*
+Package render draws to windows and pixmaps using the X RENDER extension.
+
+It replaces the PutImage/background-pixmap path in the xgraphics package
+with proper Picture-based compositing, which sidesteps the
+(2^16 * 4)-byte PutImage request size limit that plagues xgraphics.PaintImg
+and gives us real alpha blending instead of manually pre-blending onto a
+solid background color.
+*/
+package render
+
+import (
+	"fmt"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/BurntSushi/xgb/render"
+	"github.com/BurntSushi/xgb/xproto"
+
+	"github.com/BurntSushi/xgbutil"
+)
+
+// Picture wraps a RENDER Picture along with the XUtil connection that
+// created it, so callers don't have to keep threading xu around.
+type Picture struct {
+	xu  *xgbutil.XUtil
+	Pic render.Picture
+}
+
+// NewPicture creates a RENDER Picture for 'src', which may be the id of
+// either a window or a pixmap. 'pictFormat' must describe a format
+// compatible with src's depth; use FindFormat to look one up from the
+// formats advertised by the RENDER extension.
+func NewPicture(xu *xgbutil.XUtil, src xproto.Drawable,
+	pictFormat render.Pictformat, valueMask uint32,
+	values render.CreatePictureValueList) (*Picture, error) {
+
+	pid, err := render.NewPictureId(xu.Conn())
+	if err != nil {
+		return nil, err
+	}
+
+	err = render.CreatePictureChecked(xu.Conn(), pid, src, pictFormat,
+		valueMask, values).Check()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Picture{xu: xu, Pic: pid}, nil
+}
+
+// Destroy frees the Picture. It does not free the underlying drawable.
+func (p *Picture) Destroy() error {
+	return render.FreePictureChecked(p.xu.Conn(), p.Pic).Check()
+}
+
+// FindFormat searches the formats reported by RENDER's QueryPictFormats
+// and returns the first direct-color format with the given 'depth'. The
+// channel layout (masks and shifts) is not compared. It's enough to create
+// Pictures for the pixmaps and windows xgraphics deals with.
+func FindFormat(xu *xgbutil.XUtil, depth byte) (render.Pictformat, error) {
+	reply, err := render.QueryPictFormats(xu.Conn()).Reply()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, pf := range reply.Formats {
+		if pf.Depth == depth && pf.Type == render.PictTypeDirect {
+			return pf.Id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("render: no Pictformat found for depth %d", depth)
+}
+
+// Composite draws 'src' (optionally filtered through 'mask') onto 'dst'
+// using RENDER's Composite request with operator 'op' (e.g.
+// render.PictOpOver, render.PictOpSrc). It replaces the BlendBg hack in
+// xgraphics, which had to pre-blend images onto a solid background because
+// PutImage has no notion of alpha.
+func Composite(op byte, src, mask, dst *Picture,
+	srcX, srcY, maskX, maskY, dstX, dstY int16,
+	width, height uint16) error {
+
+	var maskPic render.Picture
+	if mask != nil {
+		maskPic = mask.Pic
+	}
+
+	return render.CompositeChecked(op, src.Pic, maskPic, dst.Pic,
+		srcX, srcY, maskX, maskY, dstX, dstY, width, height).Check()
+}
+
+// FillRectangles paints 'rects' on 'dst' with a solid 'color' using
+// RENDER's FillRectangles request, which is the proper replacement for
+// hand-rolling solid fills through PutImage.
+func FillRectangles(op byte, dst *Picture, color render.Color,
+	rects []xproto.Rectangle) error {
+
+	return render.FillRectanglesChecked(op, dst.Pic, color, rects).Check()
+}
+
+// GlyphInfo mirrors the metrics RENDER needs for each glyph: the bitmap's
+// dimensions, its origin relative to the pen position (x, y are negative
+// bearings), and the distance to advance the pen afterward (xOff, yOff).
+type GlyphInfo struct {
+	Width, Height uint16
+	X, Y          int16
+	XOff, YOff    int16
+}
+
+// GlyphSet lazily rasterizes glyphs from a font.Face and uploads them to
+// the X server via RENDER's glyph set machinery, so repeated draws of the
+// same rune only pay the rasterization cost once.
+type GlyphSet struct {
+	xu        *xgbutil.XUtil
+	Set       render.Glyphset
+	face      font.Face
+	attempted map[rune]bool // rasterization attempted, success or not
+	ok        map[rune]bool // true if the rune actually made it into Set
+}
+
+// NewGlyphSet creates an empty 8-bit-alpha glyph set backed by 'face'.
+// Glyphs are rasterized and uploaded on demand as DrawString encounters
+// runes it hasn't seen yet.
+func NewGlyphSet(xu *xgbutil.XUtil, face font.Face) (*GlyphSet, error) {
+	formatA8, err := FindFormat(xu, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := render.NewGlyphsetId(xu.Conn())
+	if err != nil {
+		return nil, err
+	}
+
+	err = render.CreateGlyphSetChecked(xu.Conn(), gid, formatA8).Check()
+	if err != nil {
+		return nil, err
+	}
+
+	return &GlyphSet{
+		xu:        xu,
+		Set:       gid,
+		face:      face,
+		attempted: make(map[rune]bool),
+		ok:        make(map[rune]bool),
+	}, nil
+}
+
+// renderable reports whether 'r' has actually been uploaded to Set. It's
+// false both before ensure has run for 'r' and after ensure has run and
+// found that the face has no glyph for it.
+func (gs *GlyphSet) renderable(r rune) bool {
+	return gs.ok[r]
+}
+
+// ensure rasterizes and uploads 'r' if it hasn't been added to the glyph
+// set yet. If the face has no glyph for 'r' at all (routine for, say, a
+// BDF face asked to draw a rune outside its repertoire), ensure leaves it
+// unregistered rather than erroring -- it's up to the caller (DrawString)
+// to skip runes that never became renderable.
+func (gs *GlyphSet) ensure(r rune) error {
+	if gs.attempted[r] {
+		return nil
+	}
+	gs.attempted[r] = true
+
+	dr, mask, _, advance, ok := gs.face.Glyph(fixed.Point26_6{}, r)
+	if !ok {
+		return nil
+	}
+
+	bounds := dr
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// RENDER wants a tightly packed A8 bitmap; extract it from whatever
+	// image.Image the face gave us for the mask.
+	a8 := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			_, _, _, a := mask.At(mask.Bounds().Min.X+x,
+				mask.Bounds().Min.Y+y).RGBA()
+			a8[y*width+x] = byte(a >> 8)
+		}
+	}
+
+	info := GlyphInfo{
+		Width:  uint16(width),
+		Height: uint16(height),
+		X:      int16(-bounds.Min.X),
+		Y:      int16(-bounds.Min.Y),
+		XOff:   int16(advance.Round()),
+		YOff:   0,
+	}
+
+	err := render.AddGlyphsChecked(gs.xu.Conn(), gs.Set,
+		[]render.Glyph{render.Glyph(uint32(r))},
+		[]render.Glyphinfo{{
+			Width:  info.Width,
+			Height: info.Height,
+			X:      info.X,
+			Y:      info.Y,
+			XOff:   info.XOff,
+			YOff:   info.YOff,
+		}},
+		a8).Check()
+	if err != nil {
+		return err
+	}
+
+	gs.ok[r] = true
+	return nil
+}
+
+// Free releases the glyph set.
+func (gs *GlyphSet) Free() error {
+	return render.FreeGlyphSetChecked(gs.xu.Conn(), gs.Set).Check()
+}
+
+// run is a maximal span of consecutive glyphs that can be emitted under a
+// single CompositeGlyphs element header (i.e. the pen didn't need to jump).
+type run struct {
+	deltaX, deltaY int16
+	runes          []rune
+}
+
+// DrawString draws 'text' onto 'pic' at (x, y) using glyphs from 'gs',
+// uploading any glyph that hasn't been seen before. It replaces
+// DrawText/TextExtents, which could only cope with monospaced-ish TTF
+// rendering through freetype directly.
+func DrawString(pic *Picture, gs *GlyphSet, x, y int, color render.Color,
+	text string) error {
+
+	for _, r := range text {
+		if err := gs.ensure(r); err != nil {
+			return err
+		}
+	}
+
+	srcFill, err := solidFill(pic.xu, color)
+	if err != nil {
+		return err
+	}
+	defer srcFill.Destroy()
+
+	runs := splitRuns(gs, text)
+	elemSize := elementSizeFor(runs)
+
+	pen := fixed.P(x, y)
+	for _, rn := range runs {
+		pen.X += fixed.I(int(rn.deltaX))
+		pen.Y += fixed.I(int(rn.deltaY))
+
+		if err := compositeRun(pic, gs, srcFill, elemSize, rn, pen); err != nil {
+			return err
+		}
+		for _, r := range rn.runes {
+			adv, _ := gs.face.GlyphAdvance(r)
+			pen.X += adv
+		}
+	}
+
+	return nil
+}
+
+// splitRuns walks 'text' and groups consecutive renderable runes (ones
+// GlyphSet actually has a glyph for) into runs, so they can be packed
+// into a single CompositeGlyphs element. Runes the face has no glyph for
+// -- routine for, say, a BDF face drawing a codepoint outside its
+// repertoire -- are never fed to the composite buffer; instead their
+// advance accumulates into the following run's deltaX/deltaY, so the
+// cursor still jumps over the gap they leave.
+func splitRuns(gs *GlyphSet, text string) []run {
+	var runs []run
+	var current []rune
+	var skipX, skipY fixed.Int26_6
+
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		runs = append(runs, run{
+			deltaX: int16(skipX.Round()),
+			deltaY: int16(skipY.Round()),
+			runes:  current,
+		})
+		current = nil
+		skipX, skipY = 0, 0
+	}
+
+	for _, r := range text {
+		if !gs.renderable(r) {
+			flush()
+			skipX += fallbackAdvance(gs.face, r)
+			continue
+		}
+		current = append(current, r)
+	}
+	flush()
+
+	return runs
+}
+
+// fallbackAdvance picks how far to move the pen for a rune that has no
+// glyph in the face, so later characters don't end up overlapping it. It
+// prefers the face's own notion of that rune's advance (a face may know
+// the width of a rune it declines to rasterize) and falls back to half
+// the face's line height, the traditional width of a "missing glyph" box.
+// TextExtents uses the same fallback so a layout sized from it has
+// already reserved the space DrawString will actually use.
+func fallbackAdvance(face font.Face, r rune) fixed.Int26_6 {
+	if adv, ok := face.GlyphAdvance(r); ok {
+		return adv
+	}
+	return face.Metrics().Height / 2
+}
+
+// elementSizeFor chooses the smallest CompositeGlyphs element size
+// (8/16/32 bits) that can hold every rune actually emitted across 'runs'
+// as a glyph id.
+func elementSizeFor(runs []run) int {
+	max := rune(0)
+	for _, rn := range runs {
+		for _, r := range rn.runes {
+			if r > max {
+				max = r
+			}
+		}
+	}
+	switch {
+	case max <= 0xff:
+		return 8
+	case max <= 0xffff:
+		return 16
+	default:
+		return 32
+	}
+}
+
+// compositeRun packs 'rn' into a single CompositeGlyphs{8,16,32} element
+// (1-byte length, 3 bytes padding, int16 deltaX, int16 deltaY, then the
+// codepoints themselves padded to a 4-byte boundary) and issues the
+// request.
+//
+// Each run is issued as its own single-element request whose xSrc/ySrc
+// already sit at 'pen' -- which DrawString has advanced by rn.deltaX/
+// deltaY to account for any skipped glyphs before this run. The element
+// header's own delta must therefore be zero here: it's relative to
+// xSrc/ySrc, so baking rn.deltaX/deltaY into it *as well* would shift
+// this run an extra jump's worth to the right/down of where it belongs.
+// (A header delta only matters when multiple elements share one request,
+// which this implementation doesn't do.)
+func compositeRun(pic *Picture, gs *GlyphSet, src *Picture, elemSize int,
+	rn run, pen fixed.Point26_6) error {
+
+	buf := []byte{
+		byte(len(rn.runes)), 0, 0, 0,
+		0, 0,
+		0, 0,
+	}
+
+	for _, r := range rn.runes {
+		switch elemSize {
+		case 8:
+			buf = append(buf, byte(r))
+		case 16:
+			buf = append(buf, byte(r), byte(r>>8))
+		default:
+			buf = append(buf, byte(r), byte(r>>8), byte(r>>16), byte(r>>24))
+		}
+	}
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+
+	x, y := pen.X.Round(), pen.Y.Round()
+
+	switch elemSize {
+	case 8:
+		return render.CompositeGlyphs8Checked(render.PictOpOver, src.Pic,
+			pic.Pic, 0, gs.Set, int16(x), int16(y), buf).Check()
+	case 16:
+		return render.CompositeGlyphs16Checked(render.PictOpOver, src.Pic,
+			pic.Pic, 0, gs.Set, int16(x), int16(y), buf).Check()
+	default:
+		return render.CompositeGlyphs32Checked(render.PictOpOver, src.Pic,
+			pic.Pic, 0, gs.Set, int16(x), int16(y), buf).Check()
+	}
+}
+
+// solidFill creates a 1x1 repeating Picture filled with 'color', which is
+// the usual RENDER trick for drawing text in a solid color: the glyph
+// mask supplies the shape, this Picture supplies the color.
+func solidFill(xu *xgbutil.XUtil, color render.Color) (*Picture, error) {
+	pid, err := render.NewPictureId(xu.Conn())
+	if err != nil {
+		return nil, err
+	}
+
+	err = render.CreateSolidFillChecked(xu.Conn(), pid, color).Check()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Picture{xu: xu, Pic: pid}, nil
+}
+
+// TextExtents sums glyph advances from the face to compute the pixel
+// width and height 'text' would occupy when drawn with DrawString. Unlike
+// the old xgraphics.TextExtents (which assumed every glyph was EM-square
+// wide), this handles proportional fonts and mixed scripts correctly.
+func TextExtents(face font.Face, text string) (width, height int) {
+	var w fixed.Int26_6
+
+	metrics := face.Metrics()
+	height = metrics.Height.Round()
+
+	for _, r := range text {
+		w += fallbackAdvance(face, r)
+	}
+
+	return w.Round(), height
+}
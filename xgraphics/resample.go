@@ -0,0 +1,229 @@
+/*
+	resample.go implements image resampling for xgraphics, replacing the
+	reliance on code.google.com/p/graphics-go/graphics's Scale, which only
+	ever did a reasonable job on proportional dimensions.
+*/
+package xgraphics
+
+import (
+	"image"
+	"math"
+)
+
+// ResampleKernel selects the filter used when scaling an image to a new
+// size. NearestNeighbor is cheap and blocky; Bilinear is a good general
+// purpose default; CatmullRom is sharper and more expensive, and is a
+// good choice for shrinking large icons down.
+type ResampleKernel int
+
+const (
+	NearestNeighbor ResampleKernel = iota
+	Bilinear
+	CatmullRom
+)
+
+// weight func returns the kernel weight for a sample at distance 'd'
+// (in source pixels) from the destination pixel center.
+func (k ResampleKernel) weight(d float64) float64 {
+	switch k {
+	case NearestNeighbor:
+		if d <= 0.5 {
+			return 1
+		}
+		return 0
+	case Bilinear:
+		if d >= 1 {
+			return 0
+		}
+		return 1 - d
+	case CatmullRom:
+		// Standard Catmull-Rom cubic convolution (a = -0.5).
+		const a = -0.5
+		if d <= 1 {
+			return (a+2)*d*d*d - (a+3)*d*d + 1
+		}
+		if d < 2 {
+			return a*d*d*d - 5*a*d*d + 8*a*d - 4*a
+		}
+		return 0
+	}
+	return 0
+}
+
+// support returns the kernel's radius of influence in source pixels.
+func (k ResampleKernel) support() float64 {
+	switch k {
+	case NearestNeighbor:
+		return 0.5
+	case Bilinear:
+		return 1
+	case CatmullRom:
+		return 2
+	}
+	return 1
+}
+
+// axisWeights builds, for each of the 'dstLen' output pixels along one
+// axis, the starting source index and the normalized kernel weights to
+// convolve against.
+func (k ResampleKernel) axisWeights(srcLen, dstLen int) []struct {
+	start   int
+	weights []float32
+} {
+	scale := float64(srcLen) / float64(dstLen)
+	support := k.support()
+	// When shrinking, widen the filter so we don't alias -- the standard
+	// trick of scaling the kernel's support by the zoom factor.
+	filterScale := scale
+	if filterScale < 1 {
+		filterScale = 1
+	}
+	radius := support * filterScale
+
+	out := make([]struct {
+		start   int
+		weights []float32
+	}, dstLen)
+
+	for i := 0; i < dstLen; i++ {
+		center := (float64(i) + 0.5) * scale
+		start := int(center - radius)
+		end := int(center + radius)
+		if start < 0 {
+			start = 0
+		}
+		if end >= srcLen {
+			end = srcLen - 1
+		}
+
+		weights := make([]float32, end-start+1)
+		var sum float32
+		for j := start; j <= end; j++ {
+			d := math.Abs(float64(j)+0.5-center) / filterScale
+			w := float32(k.weight(d))
+			weights[j-start] = w
+			sum += w
+		}
+		if sum != 0 {
+			for j := range weights {
+				weights[j] /= sum
+			}
+		}
+
+		out[i].start = start
+		out[i].weights = weights
+	}
+
+	return out
+}
+
+// Resample scales 'src' to an image of size (width, height) using kernel
+// 'k'. It's a separable two-pass filter: the X kernel convolves source
+// rows into a temporary scanline buffer, then the Y kernel convolves
+// those scanlines into the destination. Alpha is premultiplied before
+// filtering and unpremultiplied after, so transparent icon edges don't
+// pick up dark halos from the fully-transparent pixels behind them.
+func (k ResampleKernel) Resample(src image.Image, width, height int) *image.RGBA {
+	sb := src.Bounds()
+	srcW, srcH := sb.Dx(), sb.Dy()
+
+	premul := premultiply(src)
+
+	xw := k.axisWeights(srcW, width)
+	yw := k.axisWeights(srcH, height)
+
+	// Horizontal pass: srcH rows of width 'width', still premultiplied.
+	tmp := make([][4]float32, width*srcH)
+	for y := 0; y < srcH; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float32
+			for j, w := range xw[x].weights {
+				p := premul[y*srcW+xw[x].start+j]
+				r += p[0] * w
+				g += p[1] * w
+				b += p[2] * w
+				a += p[3] * w
+			}
+			tmp[y*width+x] = [4]float32{r, g, b, a}
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float32
+			for j, w := range yw[y].weights {
+				p := tmp[(yw[y].start+j)*width+x]
+				r += p[0] * w
+				g += p[1] * w
+				b += p[2] * w
+				a += p[3] * w
+			}
+			dst.Set(x, y, unpremultiply(r, g, b, a))
+		}
+	}
+
+	return dst
+}
+
+// premultiply extracts src's pixels into a flat, row-major slice of
+// premultiplied float32 RGBA, scaled to [0, 1].
+func premultiply(src image.Image) [][4]float32 {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([][4]float32, w*h)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, a := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			out[y*w+x] = [4]float32{
+				float32(r) / 0xffff,
+				float32(g) / 0xffff,
+				float32(bl) / 0xffff,
+				float32(a) / 0xffff,
+			}
+		}
+	}
+
+	return out
+}
+
+// unpremultiply converts a premultiplied, [0, 1]-scaled RGBA sample back
+// into a color.Color suitable for image.RGBA.Set.
+func unpremultiply(r, g, b, a float32) rgba64 {
+	if a <= 0 {
+		return rgba64{}
+	}
+	if a > 1 {
+		a = 1
+	}
+
+	return rgba64{
+		r: clamp01(r / a),
+		g: clamp01(g / a),
+		b: clamp01(b / a),
+		a: a,
+	}
+}
+
+func clamp01(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// rgba64 implements color.Color over our float32 working precision. It
+// holds straight (non-premultiplied) channels; RGBA premultiplies them, as
+// color.Color requires.
+type rgba64 struct {
+	r, g, b, a float32
+}
+
+func (c rgba64) RGBA() (r, g, b, a uint32) {
+	return uint32(c.r * c.a * 0xffff), uint32(c.g * c.a * 0xffff),
+		uint32(c.b * c.a * 0xffff), uint32(c.a * 0xffff)
+}
@@ -15,11 +15,10 @@ import (
     "image/draw"
     "image/png"
     "io/ioutil"
+    "math"
     "os"
 )
 
-import "code.google.com/p/graphics-go/graphics"
-
 import "code.google.com/p/freetype-go/freetype"
 import "code.google.com/p/freetype-go/freetype/truetype"
 
@@ -224,62 +223,52 @@ func BlendBg(img image.Image, mask draw.Image, transparency int,
     return
 }
 
-// Scale is a simple wrapper around graphics.Scale. It will also scale a
-// mask appropriately.
+// Scale resizes img (and, if given, mask) to width x height using a
+// CatmullRom resample. It replaces the old wrapper around
+// code.google.com/p/graphics-go/graphics.Scale, whose nearest-neighbor-ish
+// behavior left hard edges and dark halos around transparent icons.
 func Scale(img image.Image, mask image.Image,
            width, height int) (dimg draw.Image, dmask draw.Image) {
-    dimg = image.NewRGBA(image.Rect(0, 0, width, height))
-    graphics.Scale(dimg, img)
+    dimg = CatmullRom.Resample(img, width, height)
 
     if mask != nil {
-        dmask = image.NewRGBA(image.Rect(0, 0, width, height))
-        graphics.Scale(dmask, mask)
+        dmask = CatmullRom.Resample(mask, width, height)
     }
 
     return
 }
 
 // FindBestIcon takes width/height dimensions and a slice of *ewmh.WmIcon
-// and finds the best matching icon of the bunch. We always prefer bigger.
-// If no icons are bigger than the preferred dimensions, use the biggest
-// available. Otherwise, use the smallest icon that is greater than or equal
-// to the preferred dimensions. The preferred dimensions is essentially
-// what you'll likely scale the resulting icon to.
-// XXX: It seems that Google's 'Scale' in the graphics package will only work
-// with proportional dimensions. Therefore, we enforce that constraint here.
+// and finds the best matching icon of the bunch: the one whose area is
+// closest to the preferred area, in either direction. The preferred
+// dimensions is essentially what you'll likely scale the resulting icon
+// to.
+// Earlier versions of this function refused any icon that wasn't
+// proportional to the requested dimensions, because the old Scale could
+// only really cope with that case. Now that Scale uses a real resampler
+// (see resample.go), that restriction is gone -- non-square icons (e.g.
+// 22x16 tray icons) are no longer silently dropped.
 func FindBestIcon(width, height uint32, icons []*ewmh.WmIcon) *ewmh.WmIcon {
     // nada nada limonada
     if len(icons) == 0 {
         return nil
     }
 
-    parea := width * height // preferred size
-    var best *ewmh.WmIcon = nil // best matching icon
-
-    var bestArea, iconArea uint32
+    parea := float64(width) * float64(height) // preferred area
+    var best *ewmh.WmIcon = nil                // best matching icon
+    var bestScore float64
 
     for _, icon := range icons {
-        // this icon isn't proportional to the requested dimensions,
-        // then we can't use it because graphics.Scale is buzz killington.
-        if !proportional(width, height, icon.Width, icon.Height) {
+        iconArea := float64(icon.Width) * float64(icon.Height)
+        if iconArea == 0 {
             continue
         }
 
-        // the first valid icon we've seen; use it!
-        if best == nil {
-            best = icon
-            continue
-        }
-
-        // load areas for comparison
-        bestArea, iconArea = best.Width * best.Height, icon.Width * icon.Height
+        score := math.Abs(math.Log(iconArea / parea))
 
-        // We don't always want to accept bigger icons if our best is
-        // already bigger. But we always want something bigger if our best
-        // is insufficient.
-        if (iconArea >= parea && iconArea <= bestArea) ||
-           (bestArea < parea && iconArea > bestArea) {
+        if best == nil || score < bestScore {
             best = icon
+            bestScore = score
         }
     }
 
@@ -290,15 +279,6 @@ func FindBestIcon(width, height uint32, icons []*ewmh.WmIcon) *ewmh.WmIcon {
     return best // this may be nil if we have no valid icons
 }
 
-// proportional takes a pair of dimensions and returns whether they are
-// proportional or not.
-func proportional(w1, h1, w2, h2 uint32) bool {
-    fw1, fh1 := float64(w1), float64(h1)
-    fw2, fh2 := float64(w2), float64(h2)
-
-    return fw1 / fh1 == fw2 / fh2
-}
-
 // EwmhIconToImage takes a ewmh.WmIcon and converts it to an image and
 // an alpha mask. A ewmh.WmIcon is in ARGB order, and the image package wants
 // things in RGBA order. (What makes things is worse is when it comes time
@@ -310,7 +290,7 @@ func EwmhIconToImage(icon *ewmh.WmIcon) (img *image.RGBA, mask *image.RGBA) {
 
     for x := 0; x < width; x++ {
         for y := 0; y < height; y++ {
-            argb := icon.Data[x + (y * height)]
+            argb := icon.Data[x + (y * width)]
             alpha := argb >> 24
             red := ((alpha << 24) ^ argb) >> 16
             green := (((alpha << 24) + (red << 16)) ^ argb) >> 8
@@ -326,3 +306,17 @@ func EwmhIconToImage(icon *ewmh.WmIcon) (img *image.RGBA, mask *image.RGBA) {
     return
 }
 
+// EwmhIconToImageScaled is EwmhIconToImage followed by a resample to
+// (w, h) using the given kernel, for both the image and its mask. It
+// decodes the full-size icon first; the decode and the resample are
+// separate passes.
+func EwmhIconToImageScaled(icon *ewmh.WmIcon, w, h int,
+                           kernel ResampleKernel) (img draw.Image, mask draw.Image) {
+    fullImg, fullMask := EwmhIconToImage(icon)
+
+    img = kernel.Resample(fullImg, w, h)
+    mask = kernel.Resample(fullMask, w, h)
+
+    return
+}
+